@@ -1,38 +1,84 @@
 package drivers
 
 import (
+	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"github.com/calavera/dkvolume"
-	"net"
+	"github.com/docker/go-plugins-helpers/volume"
+	"io/ioutil"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
-	EfsTemplateURI = "%s.%s.efs.%s.amazonaws.com"
+	EfsTemplateURI     = "%s.%s.efs.%s.amazonaws.com"
+	DefaultEfsStateDir = "/var/lib/docker-volume-netshare/efs"
+
+	FilesystemOpt = "filesystem"
+	AvailZoneOpt  = "az"
+	SubpathOpt    = "path"
+	MountOptsOpt  = "mountopts"
+
+	DefaultEfsMountOpts = "nfsvers=4.1"
 )
 
+// efsVolume is the persisted record behind a named EFS volume: everything
+// Create learned from --opt, plus the mountpoint it was assigned.
+type efsVolume struct {
+	Name       string            `json:"name"`
+	Filesystem string            `json:"filesystem"`
+	AvailZone  string            `json:"az,omitempty"`
+	Subpath    string            `json:"path,omitempty"`
+	MountOpts  string            `json:"mountopts,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Mountpoint string            `json:"mountpoint"`
+}
+
 type efsDriver struct {
-	root      string
-	availzone string
-	resolve   bool
-	region    string
-	mountm    *mountManager
-	m         *sync.Mutex
-	dnscache  map[string]string
+	root       string
+	statePath  string
+	availzone  string
+	resolve    bool
+	region     string
+	mountm     *mountManager
+	m          *sync.Mutex
+	resolver   Resolver
+	roundRobin uint64
+	volumes    map[string]*efsVolume
+
+	// mountVolume/unmountVolume perform the actual mount(2)/umount(2) work.
+	// They're fields rather than direct calls to the package-level
+	// createDest/run helpers so tests can substitute a fake and exercise
+	// Mount/Unmount's locking and refcounting without touching a real
+	// filesystem.
+	mountVolume   func(vol *efsVolume, dest, source string) error
+	unmountVolume func(dest string) error
 }
 
-func NewEFSDriver(root, az string, resolve bool) efsDriver {
+var _ volume.Driver = (*efsDriver)(nil)
+
+// NewEFSDriver builds an EFS driver. dnsTTL controls how long a resolved
+// mount target is trusted before Resolve looks it up again; pass 0 to use
+// DefaultResolveTTL. This argument is the only way to set it; this package
+// reads no command-line flag for it.
+func NewEFSDriver(root, az string, resolve bool, dnsTTL time.Duration) *efsDriver {
 
-	d := efsDriver{
-		root:     root,
-		resolve:  resolve,
-		mountm:   NewVolumeManager(),
-		m:        &sync.Mutex{},
-		dnscache: map[string]string{},
+	d := &efsDriver{
+		root:      root,
+		statePath: filepath.Join(DefaultEfsStateDir, "state.json"),
+		resolve:   resolve,
+		mountm:    NewVolumeManager(),
+		m:         &sync.Mutex{},
+		resolver:  NewResolver(dnsTTL),
+		volumes:   map[string]*efsVolume{},
 	}
+	d.mountVolume = d.realMountVolume
+	d.unmountVolume = d.realUnmountVolume
+
 	md, err := fetchAWSMetaData()
 	if err != nil {
 		log.Fatalf("Error resolving AWS metadata: %s\n", err.Error())
@@ -41,99 +87,277 @@ func NewEFSDriver(root, az string, resolve bool) efsDriver {
 	d.region = md.Region
 	if az == "" {
 		d.availzone = md.AvailZone
+	} else {
+		d.availzone = az
+	}
+
+	if err := d.loadState(); err != nil {
+		log.Errorf("Error loading EFS volume state from %s: %s\n", d.statePath, err.Error())
 	}
+
 	return d
 }
 
-func (e efsDriver) Create(r dkvolume.Request) dkvolume.Response {
-	return dkvolume.Response{}
+func (e *efsDriver) realMountVolume(vol *efsVolume, dest, source string) error {
+	if err := createDest(dest); err != nil {
+		return err
+	}
+	return run(fmt.Sprintf("mount -t nfs4 -o %s %s %s", vol.MountOpts, source, dest))
 }
 
-func (e efsDriver) Remove(r dkvolume.Request) dkvolume.Response {
-	log.Debugf("Removing volume %s\n", r.Name)
-	return dkvolume.Response{}
+func (e *efsDriver) realUnmountVolume(dest string) error {
+	if err := run(fmt.Sprintf("umount %s", dest)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dest)
+}
+
+// loadState restores previously created volumes so they survive a daemon
+// restart. A missing state file just means a fresh install.
+func (e *efsDriver) loadState() error {
+	data, err := ioutil.ReadFile(e.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &e.volumes)
 }
 
-func (e efsDriver) Path(r dkvolume.Request) dkvolume.Response {
-	log.Debugf("Path for %s is at %s\n", r.Name, mountpoint(e.root, r.Name))
-	return dkvolume.Response{Mountpoint: mountpoint(e.root, r.Name)}
+func (e *efsDriver) saveState() error {
+	if err := os.MkdirAll(filepath.Dir(e.statePath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(e.volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(e.statePath, data, 0644)
 }
 
-func (e efsDriver) Mount(r dkvolume.Request) dkvolume.Response {
+func (e *efsDriver) Create(r *volume.CreateRequest) error {
+	log.Debugf("Create: %s, %v\n", r.Name, r.Options)
 	e.m.Lock()
 	defer e.m.Unlock()
-	dest := mountpoint(e.root, r.Name)
-	source := e.fixSource(r.Name)
 
-	if e.mountm.HasMount(dest) && e.mountm.Count(dest) > 0 {
-		log.Infof("Using existing EFS volume mount: %s\n", dest)
-		e.mountm.Increment(dest)
-		return dkvolume.Response{Mountpoint: dest}
+	if _, found := e.volumes[r.Name]; found {
+		return fmt.Errorf("volume %s already exists", r.Name)
 	}
 
-	log.Infof("Mounting EFS volume %s on %s\n", source, dest)
+	fs, ok := r.Options[FilesystemOpt]
+	if !ok || fs == "" {
+		return fmt.Errorf("the '%s' option is required to create an EFS volume", FilesystemOpt)
+	}
 
-	if err := createDest(dest); err != nil {
-		return dkvolume.Response{Err: err.Error()}
+	vol := &efsVolume{
+		Name:       r.Name,
+		Filesystem: fs,
+		AvailZone:  e.availzone,
+		MountOpts:  DefaultEfsMountOpts,
+		Mountpoint: mountpoint(e.root, r.Name),
 	}
 
-	if err := mountVolume(source, dest, 4); err != nil {
-		return dkvolume.Response{Err: err.Error()}
+	for k, v := range r.Options {
+		switch k {
+		case FilesystemOpt:
+			// already consumed above
+		case AvailZoneOpt:
+			vol.AvailZone = v
+		case SubpathOpt:
+			vol.Subpath = v
+		case MountOptsOpt:
+			vol.MountOpts = v
+		default:
+			if vol.Labels == nil {
+				vol.Labels = map[string]string{}
+			}
+			vol.Labels[k] = v
+		}
 	}
-	e.mountm.Add(dest, r.Name)
-	return dkvolume.Response{Mountpoint: dest}
+
+	e.volumes[r.Name] = vol
+	return e.saveState()
 }
 
-func (e efsDriver) Unmount(r dkvolume.Request) dkvolume.Response {
+func (e *efsDriver) Remove(r *volume.RemoveRequest) error {
+	log.Debugf("Removing volume %s\n", r.Name)
 	e.m.Lock()
 	defer e.m.Unlock()
-	dest := mountpoint(e.root, r.Name)
-	source := e.fixSource(r.Name)
-
-	if e.mountm.HasMount(dest) {
-		if e.mountm.Count(dest) > 1 {
-			log.Infof("Skipping unmount for %s - in use by other containers\n", dest)
-			e.mountm.Decrement(dest)
-			return dkvolume.Response{}
-		}
-		e.mountm.Decrement(dest)
+
+	if _, found := e.volumes[r.Name]; !found {
+		return fmt.Errorf("volume %s not found", r.Name)
 	}
 
-	log.Infof("Unmounting volume %s from %s\n", source, dest)
+	delete(e.volumes, r.Name)
+	return e.saveState()
+}
+
+func (e *efsDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
+	e.m.Lock()
+	vol, found := e.volumes[r.Name]
+	e.m.Unlock()
+	if !found {
+		return nil, fmt.Errorf("volume %s not found", r.Name)
+	}
+	log.Debugf("Path for %s is at %s\n", r.Name, vol.Mountpoint)
+	return &volume.PathResponse{Mountpoint: vol.Mountpoint}, nil
+}
 
-	if err := run(fmt.Sprintf("umount %s", dest)); err != nil {
-		return dkvolume.Response{Err: err.Error()}
+func (e *efsDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	e.m.Lock()
+	vol, found := e.volumes[r.Name]
+	e.m.Unlock()
+	if !found {
+		return nil, fmt.Errorf("volume %s not found", r.Name)
 	}
+	return &volume.GetResponse{Volume: e.toDockerVolume(vol)}, nil
+}
 
-	if err := os.RemoveAll(dest); err != nil {
-		return dkvolume.Response{Err: err.Error()}
+func (e *efsDriver) List() (*volume.ListResponse, error) {
+	e.m.Lock()
+	known := make([]*efsVolume, 0, len(e.volumes))
+	for _, vol := range e.volumes {
+		known = append(known, vol)
 	}
+	e.m.Unlock()
 
-	return dkvolume.Response{}
+	// toDockerVolume can block on statfs(2) or a DNS lookup; building it must
+	// happen outside e.m so one unreachable volume can't stall every other
+	// Create/Get/List/Path/Mount/Unmount call.
+	vols := make([]*volume.Volume, 0, len(known))
+	for _, vol := range known {
+		vols = append(vols, e.toDockerVolume(vol))
+	}
+	return &volume.ListResponse{Volumes: vols}, nil
 }
 
-func (e efsDriver) fixSource(name string) string {
-	v := strings.Split(name, "/")
+// toDockerVolume renders vol's static opts plus its current runtime status
+// (refcount, last-mount time, resolved addresses, free space) so `docker
+// volume inspect` has something useful to show.
+func (e *efsDriver) toDockerVolume(vol *efsVolume) *volume.Volume {
+	status := map[string]interface{}{
+		FilesystemOpt: vol.Filesystem,
+		AvailZoneOpt:  vol.AvailZone,
+		MountOptsOpt:  vol.MountOpts,
+	}
+
+	if entry, ok := e.mountm.Get(vol.Mountpoint); ok {
+		status["refcount"] = entry.count
+		status["lastmount"] = entry.mountedAt.Format(time.RFC3339)
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(vol.Mountpoint, &stat); err == nil {
+			status["bytesfree"] = uint64(stat.Bsize) * stat.Bavail
+		}
+	}
+
 	if e.resolve {
-		uri := fmt.Sprintf(EfsTemplateURI, e.availzone, v[0], e.region)
-		if i, ok := e.dnscache[uri]; ok {
-			return mountSuffix(i)
+		uri := e.mountTargetURI(vol)
+		if ips, err := e.resolver.Resolve(uri); err == nil && len(ips) > 0 {
+			addrs := make([]string, len(ips))
+			for i, ip := range ips {
+				addrs[i] = ip.String()
+			}
+			status["addresses"] = addrs
+		}
+	}
+
+	return &volume.Volume{
+		Name:       vol.Name,
+		Mountpoint: vol.Mountpoint,
+		Status:     status,
+	}
+}
+
+func (e *efsDriver) Capabilities() *volume.CapabilitiesResponse {
+	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "local"}}
+}
+
+func (e *efsDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	e.m.Lock()
+	vol, found := e.volumes[r.Name]
+	e.m.Unlock()
+	if !found {
+		return nil, fmt.Errorf("volume %s not found", r.Name)
+	}
+
+	dest := vol.Mountpoint
+	lock := e.mountm.MountLock(dest)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if e.mountm.Increment(dest) > 1 {
+		// An earlier caller already held dest's lock and mounted it. Every
+		// Increment here happens under that lock, and a failed mount deletes
+		// the entry before releasing it, so the next caller starts back at 1
+		// and tries the mount itself rather than reporting success.
+		if entry, ok := e.mountm.Get(dest); ok && entry.count > 0 {
+			log.Infof("Using existing EFS volume mount: %s\n", dest)
+			return &volume.MountResponse{Mountpoint: dest}, nil
 		}
+		e.mountm.Decrement(dest)
+		return nil, fmt.Errorf("mount of %s did not succeed", dest)
+	}
+
+	source := e.fixSource(vol)
+	log.Infof("Mounting EFS volume %s on %s\n", source, dest)
+
+	if err := e.mountVolume(vol, dest, source); err != nil {
+		e.mountm.Delete(dest)
+		return nil, err
+	}
+	return &volume.MountResponse{Mountpoint: dest}, nil
+}
+
+func (e *efsDriver) Unmount(r *volume.UnmountRequest) error {
+	e.m.Lock()
+	vol, found := e.volumes[r.Name]
+	e.m.Unlock()
+	if !found {
+		return fmt.Errorf("volume %s not found", r.Name)
+	}
+
+	dest := vol.Mountpoint
+
+	if e.mountm.Decrement(dest) > 0 {
+		log.Infof("Skipping unmount for %s - in use by other containers\n", dest)
+		return nil
+	}
 
-		log.Debugf("Attempting to resolve: %s", uri)
-		if ips, err := net.LookupHost(uri); err == nil {
-			log.Debugf("Resolved Addresses: %v", ips)
-			e.dnscache[uri] = ips[0]
-			return mountSuffix(ips[0])
-		} else {
-			log.Errorf("Error during resolve: %s", err.Error())
-			return mountSuffix(uri)
+	lock := e.mountm.MountLock(dest)
+	lock.Lock()
+	defer lock.Unlock()
+
+	log.Infof("Unmounting volume %s from %s\n", r.Name, dest)
+
+	return e.unmountVolume(dest)
+}
+
+func (e *efsDriver) mountTargetURI(vol *efsVolume) string {
+	return fmt.Sprintf(EfsTemplateURI, vol.AvailZone, vol.Filesystem, e.region)
+}
+
+func (e *efsDriver) fixSource(vol *efsVolume) string {
+	uri := e.mountTargetURI(vol)
+	host := uri
+
+	if e.resolve {
+		if ips, err := e.resolver.Resolve(uri); err != nil {
+			log.Errorf("Error resolving %s: %s\n", uri, err.Error())
+		} else if len(ips) > 0 {
+			idx := atomic.AddUint64(&e.roundRobin, 1) % uint64(len(ips))
+			host = ips[idx].String()
 		}
 	}
-	v[0] = v[0] + ":"
-	return strings.Join(v, "/")
+
+	return mountSuffix(host, vol.Subpath)
 }
 
-func mountSuffix(uri string) string {
-	return uri + ":/"
+func mountSuffix(host, subpath string) string {
+	if subpath == "" {
+		subpath = "/"
+	} else if subpath[0] != '/' {
+		subpath = "/" + subpath
+	}
+	return host + ":" + subpath
 }
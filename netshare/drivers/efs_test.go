@@ -0,0 +1,130 @@
+package drivers
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// newTestEFSDriver builds an efsDriver with a single pre-created volume,
+// bypassing NewEFSDriver's AWS metadata lookup, and wires mountVolume /
+// unmountVolume to counting fakes so the test can drive Mount/Unmount's real
+// locking and refcounting without touching a real filesystem.
+func newTestEFSDriver(t *testing.T, mountCalls, unmountCalls *int32) *efsDriver {
+	t.Helper()
+
+	e := &efsDriver{
+		statePath: t.TempDir() + "/state.json",
+		mountm:    NewVolumeManager(),
+		m:         &sync.Mutex{},
+		volumes: map[string]*efsVolume{
+			"myvol": {Name: "myvol", Filesystem: "fs-abc123", Mountpoint: "/mnt/netshare/myvol"},
+		},
+	}
+	e.mountVolume = func(vol *efsVolume, dest, source string) error {
+		atomic.AddInt32(mountCalls, 1)
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	e.unmountVolume = func(dest string) error {
+		atomic.AddInt32(unmountCalls, 1)
+		return nil
+	}
+	return e
+}
+
+// TestEFSDriverConcurrentMountUnmount exercises efsDriver.Mount/Unmount
+// directly (rather than hand-simulating their lock pattern): N callers racing
+// Mount for the same volume must see exactly one real mount, and every
+// caller must only get a success response once the mount has actually
+// completed - not purely off the refcount, which is the race the Mount
+// fast-path review comment called out.
+func TestEFSDriverConcurrentMountUnmount(t *testing.T) {
+	const callers = 50
+	var mountCalls, unmountCalls int32
+
+	e := newTestEFSDriver(t, &mountCalls, &unmountCalls)
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := e.Mount(&volume.MountRequest{Name: "myvol"})
+			if err != nil {
+				t.Errorf("Mount: %s", err)
+				return
+			}
+			if resp.Mountpoint != "/mnt/netshare/myvol" {
+				t.Errorf("unexpected mountpoint %q", resp.Mountpoint)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&mountCalls); got != 1 {
+		t.Fatalf("expected exactly one real mount for %d concurrent callers, got %d", callers, got)
+	}
+
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := e.Unmount(&volume.UnmountRequest{Name: "myvol"}); err != nil {
+				t.Errorf("Unmount: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&unmountCalls); got != 1 {
+		t.Fatalf("expected exactly one real unmount once every caller unmounted, got %d", got)
+	}
+	if e.mountm.HasMount("/mnt/netshare/myvol") {
+		t.Fatalf("expected the mountpoint to be untracked once every caller unmounted")
+	}
+}
+
+// TestEFSDriverMountReportsFailureToAllWaiters exercises the fast-path race
+// the review flagged: a non-first caller must not report success purely off
+// the refcount while the first caller's mount is still in flight or fails.
+func TestEFSDriverMountReportsFailureToAllWaiters(t *testing.T) {
+	const callers = 10
+	var mountCalls, unmountCalls int32
+
+	e := newTestEFSDriver(t, &mountCalls, &unmountCalls)
+	e.mountVolume = func(vol *efsVolume, dest, source string) error {
+		atomic.AddInt32(&mountCalls, 1)
+		time.Sleep(time.Millisecond)
+		return errFakeMount
+	}
+
+	var wg sync.WaitGroup
+	var failures int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := e.Mount(&volume.MountRequest{Name: "myvol"}); err != nil {
+				atomic.AddInt32(&failures, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&failures); got != callers {
+		t.Fatalf("expected every caller to see the mount failure, got %d of %d", got, callers)
+	}
+	if e.mountm.HasMount("/mnt/netshare/myvol") {
+		t.Fatalf("expected no stale mount entry left behind after a failed mount")
+	}
+}
+
+type fakeMountError string
+
+func (e fakeMountError) Error() string { return string(e) }
+
+const errFakeMount = fakeMountError("simulated mount failure")
@@ -0,0 +1,132 @@
+package drivers
+
+import (
+	"sync"
+	"time"
+)
+
+// mountEntry tracks how many containers currently hold a mountpoint open,
+// and when it was last (re)mounted.
+type mountEntry struct {
+	name      string
+	count     int
+	mountedAt time.Time
+}
+
+// mountManager is a keyed, RWMutex-protected refcount store for active
+// mountpoints. Reads (Get/HasMount/Count) take the read lock so they never
+// contend with each other; Put/Increment/Decrement/Delete take the write
+// lock only long enough to mutate a single map entry. It also hands out one
+// *sync.Mutex per destination so callers can serialize the actual mount(2)/
+// umount(2) syscalls for a given destination without blocking unrelated
+// mountpoints - a hung umount against one NFS/EFS server must never stall
+// Create/Get/List/Path/Mount/Unmount for every other volume.
+type mountManager struct {
+	mu    sync.RWMutex
+	store map[string]*mountEntry
+
+	locksMu sync.Mutex
+	locks   map[string]*sync.Mutex
+}
+
+func NewVolumeManager() *mountManager {
+	return &mountManager{
+		store: map[string]*mountEntry{},
+		locks: map[string]*sync.Mutex{},
+	}
+}
+
+// HasMount reports whether dest is currently tracked; Decrement to zero and
+// Delete both remove it.
+func (m *mountManager) HasMount(dest string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.store[dest]
+	return ok
+}
+
+// Get returns a snapshot of dest's refcount entry, if any. It's a value
+// copy taken under the read lock rather than the stored *mountEntry, so
+// callers never race Increment/Decrement/Put mutating its fields.
+func (m *mountManager) Get(dest string) (mountEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.store[dest]
+	if !ok {
+		return mountEntry{}, false
+	}
+	return *e, true
+}
+
+// Count returns the current refcount for dest, or 0 if it isn't tracked.
+func (m *mountManager) Count(dest string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if e, ok := m.store[dest]; ok {
+		return e.count
+	}
+	return 0
+}
+
+// Put records dest as freshly mounted for name with a refcount of 1.
+func (m *mountManager) Put(dest, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store[dest] = &mountEntry{name: name, count: 1, mountedAt: time.Now()}
+}
+
+// Add is an alias for Put, kept for call sites that only ever see a fresh mount.
+func (m *mountManager) Add(dest, name string) {
+	m.Put(dest, name)
+}
+
+// Delete forgets dest entirely, e.g. after a successful unmount.
+func (m *mountManager) Delete(dest string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.store, dest)
+}
+
+// Increment bumps dest's refcount and returns the new value.
+func (m *mountManager) Increment(dest string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.store[dest]
+	if !ok {
+		e = &mountEntry{mountedAt: time.Now()}
+		m.store[dest] = e
+	}
+	e.count++
+	return e.count
+}
+
+// Decrement drops dest's refcount and returns the new value, removing the
+// entry once it reaches zero.
+func (m *mountManager) Decrement(dest string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.store[dest]
+	if !ok {
+		return 0
+	}
+	e.count--
+	if e.count <= 0 {
+		delete(m.store, dest)
+		return 0
+	}
+	return e.count
+}
+
+// MountLock returns the mutex guarding the actual mount/umount syscalls for
+// dest, creating it on first use. Holding it must never be combined with
+// holding mu: it brackets slow I/O, not map access.
+func (m *mountManager) MountLock(dest string) *sync.Mutex {
+	m.locksMu.Lock()
+	defer m.locksMu.Unlock()
+	l, ok := m.locks[dest]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[dest] = l
+	}
+	return l
+}
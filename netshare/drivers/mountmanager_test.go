@@ -0,0 +1,82 @@
+package drivers
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestMountManagerConcurrentMountUnmount exercises the generic mountManager
+// primitives (Increment/Decrement/MountLock) directly under race: every
+// Increment must be matched by exactly one Decrement, and the refcount must
+// never go negative or leave a stale entry behind once every caller has
+// unmounted. This only validates the keyed store in isolation; see
+// TestEFSDriverConcurrentMountUnmount in efs_test.go for a test that drives
+// the real Mount/Unmount code path.
+func TestMountManagerConcurrentMountUnmount(t *testing.T) {
+	const dest = "/mnt/netshare/vol"
+	const callers = 50
+
+	m := NewVolumeManager()
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock := m.MountLock(dest)
+			lock.Lock()
+			m.Increment(dest)
+			lock.Unlock()
+
+			if m.Decrement(dest) == 0 {
+				lock.Lock()
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if m.HasMount(dest) {
+		t.Fatalf("expected %s to be untracked once every caller unmounted, got count %d", dest, m.Count(dest))
+	}
+}
+
+// TestMountManagerGetIsASnapshot guards against the review finding where
+// Get() handed back the live *mountEntry, letting callers race
+// Increment/Decrement mutating its fields underneath them.
+func TestMountManagerGetIsASnapshot(t *testing.T) {
+	const dest = "/mnt/netshare/vol"
+
+	m := NewVolumeManager()
+	m.Increment(dest)
+
+	entry, ok := m.Get(dest)
+	if !ok {
+		t.Fatalf("expected %s to be tracked", dest)
+	}
+
+	m.Increment(dest)
+	m.Increment(dest)
+
+	if entry.count != 1 {
+		t.Fatalf("snapshot should be unaffected by later Increment calls, got count %d", entry.count)
+	}
+	if got := m.Count(dest); got != 3 {
+		t.Fatalf("expected live count 3, got %d", got)
+	}
+}
+
+func TestMountManagerMountLockSerializesSameDest(t *testing.T) {
+	m := NewVolumeManager()
+	a := m.MountLock("/mnt/netshare/a")
+	b := m.MountLock("/mnt/netshare/a")
+	if a != b {
+		t.Fatalf("expected MountLock to return the same mutex for the same dest")
+	}
+
+	c := m.MountLock("/mnt/netshare/b")
+	if a == c {
+		t.Fatalf("expected MountLock to return distinct mutexes for distinct dests")
+	}
+}
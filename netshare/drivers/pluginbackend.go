@@ -0,0 +1,278 @@
+package drivers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	pluginMediaType = "application/vnd.docker.plugins.v1.1+json"
+
+	// BackendOpt selects which upstream plugin a volume is routed to.
+	BackendOpt = "backend"
+
+	DefaultPluginBackendStateDir = "/var/lib/docker-volume-netshare/plugin"
+)
+
+// pluginClient speaks the Docker Volume Plugin HTTP protocol to a single
+// upstream plugin over its unix socket, the same wire format docker itself
+// uses to talk to any managed volume plugin.
+type pluginClient struct {
+	addr string
+	http *http.Client
+}
+
+func newPluginClient(addr string) *pluginClient {
+	return &pluginClient{
+		addr: addr,
+		http: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.DialTimeout("unix", addr, 30*time.Second)
+				},
+			},
+		},
+	}
+}
+
+func (c *pluginClient) call(method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", "http://plugin"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", pluginMediaType)
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("backend %s: %s", c.addr, err.Error())
+	}
+	defer httpResp.Body.Close()
+
+	raw, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Err string `json:"Err"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err == nil && envelope.Err != "" {
+		return fmt.Errorf("backend %s: %s", c.addr, envelope.Err)
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, resp)
+}
+
+// pluginBackendDriver is a volume.Driver that doesn't manage any storage
+// itself: it routes Create/Mount/Unmount/Path/Remove/List/Get to a named
+// upstream Docker volume plugin over its socket, the same way podman's
+// libpod/plugin/volume_api.go delegates to external plugins. A volume picks
+// its upstream with `--opt backend=<name>` at create time; every later call
+// only carries the volume name, so the routing decision is cached here.
+type pluginBackendDriver struct {
+	m         sync.RWMutex
+	statePath string
+	backends  map[string]*pluginClient
+	volumes   map[string]string // volume name -> backend name
+}
+
+var _ volume.Driver = (*pluginBackendDriver)(nil)
+
+// NewPluginBackendDriver builds a router over the given backend name ->
+// plugin socket address map, e.g. {"foo": "/run/docker/plugins/foo.sock"}.
+// The name->backend routing table is persisted under
+// /var/lib/docker-volume-netshare/plugin/state.json, the same way
+// efsDriver persists its volume records, so it survives a daemon restart -
+// without it every call after a restart would fail with "not routed to a
+// backend" even though the upstream plugin still has the volume.
+func NewPluginBackendDriver(backends map[string]string) *pluginBackendDriver {
+	d := &pluginBackendDriver{
+		statePath: filepath.Join(DefaultPluginBackendStateDir, "state.json"),
+		backends:  map[string]*pluginClient{},
+		volumes:   map[string]string{},
+	}
+	for name, addr := range backends {
+		d.backends[name] = newPluginClient(addr)
+	}
+
+	if err := d.loadState(); err != nil {
+		log.Errorf("Error loading plugin backend routing state from %s: %s\n", d.statePath, err.Error())
+	}
+
+	return d
+}
+
+// loadState restores the volume name -> backend routing table so a daemon
+// restart doesn't orphan volumes that the upstream plugins still hold.
+func (d *pluginBackendDriver) loadState() error {
+	data, err := ioutil.ReadFile(d.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.volumes)
+}
+
+// saveState persists the routing table. Callers must hold d.m.
+func (d *pluginBackendDriver) saveState() error {
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(d.volumes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.statePath, data, 0644)
+}
+
+func (d *pluginBackendDriver) client(volName string) (*pluginClient, error) {
+	d.m.RLock()
+	name, ok := d.volumes[volName]
+	d.m.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("volume %s is not routed to a backend", volName)
+	}
+	c, ok := d.backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	return c, nil
+}
+
+func (d *pluginBackendDriver) Create(r *volume.CreateRequest) error {
+	name, ok := r.Options[BackendOpt]
+	if !ok || name == "" {
+		return fmt.Errorf("the '%s' option is required to select an upstream volume plugin", BackendOpt)
+	}
+	c, ok := d.backends[name]
+	if !ok {
+		return fmt.Errorf("unknown backend %q", name)
+	}
+
+	// Reserve the name before making the upstream call, and hold d.m for the
+	// whole check-and-reserve: checking under RLock and only writing after a
+	// successful call let two concurrent Creates for the same name both pass
+	// the check and both create a volume on their respective backends, with
+	// the later map write silently discarding one of them.
+	d.m.Lock()
+	if _, exists := d.volumes[r.Name]; exists {
+		d.m.Unlock()
+		return fmt.Errorf("volume %s already exists", r.Name)
+	}
+	d.volumes[r.Name] = name
+	d.m.Unlock()
+
+	opts := map[string]string{}
+	for k, v := range r.Options {
+		if k == BackendOpt {
+			continue
+		}
+		opts[k] = v
+	}
+
+	if err := c.call("/VolumeDriver.Create", map[string]interface{}{"Name": r.Name, "Opts": opts}, nil); err != nil {
+		d.m.Lock()
+		delete(d.volumes, r.Name)
+		d.m.Unlock()
+		return err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.saveState()
+}
+
+func (d *pluginBackendDriver) Remove(r *volume.RemoveRequest) error {
+	c, err := d.client(r.Name)
+	if err != nil {
+		return err
+	}
+	if err := c.call("/VolumeDriver.Remove", map[string]string{"Name": r.Name}, nil); err != nil {
+		return err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	delete(d.volumes, r.Name)
+	return d.saveState()
+}
+
+func (d *pluginBackendDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
+	c, err := d.client(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	var resp volume.PathResponse
+	if err := c.call("/VolumeDriver.Path", map[string]string{"Name": r.Name}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (d *pluginBackendDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
+	c, err := d.client(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	var resp volume.MountResponse
+	if err := c.call("/VolumeDriver.Mount", r, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (d *pluginBackendDriver) Unmount(r *volume.UnmountRequest) error {
+	c, err := d.client(r.Name)
+	if err != nil {
+		return err
+	}
+	return c.call("/VolumeDriver.Unmount", r, nil)
+}
+
+func (d *pluginBackendDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	c, err := d.client(r.Name)
+	if err != nil {
+		return nil, err
+	}
+	var resp volume.GetResponse
+	if err := c.call("/VolumeDriver.Get", map[string]string{"Name": r.Name}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (d *pluginBackendDriver) List() (*volume.ListResponse, error) {
+	var all []*volume.Volume
+	for name, c := range d.backends {
+		var resp volume.ListResponse
+		if err := c.call("/VolumeDriver.List", struct{}{}, &resp); err != nil {
+			log.Errorf("Error listing volumes from backend %s: %s\n", name, err.Error())
+			continue
+		}
+		all = append(all, resp.Volumes...)
+	}
+	return &volume.ListResponse{Volumes: all}, nil
+}
+
+func (d *pluginBackendDriver) Capabilities() *volume.CapabilitiesResponse {
+	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "global"}}
+}
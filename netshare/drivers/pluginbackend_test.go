@@ -0,0 +1,152 @@
+package drivers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// newStubBackend starts an httptest server bound to a unix socket under a
+// temp dir, implementing just enough of the Docker Volume Plugin protocol
+// for pluginBackendDriver to talk to.
+func newStubBackend(t *testing.T, mux *http.ServeMux) (addr string, close func()) {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "pluginbackend-test")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %s", err)
+	}
+	sock := filepath.Join(dir, "backend.sock")
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+
+	return sock, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", pluginMediaType)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestPluginBackendDriverCreateRequiresBackendOpt(t *testing.T) {
+	d := NewPluginBackendDriver(nil)
+	d.statePath = filepath.Join(t.TempDir(), "state.json")
+
+	err := d.Create(&volume.CreateRequest{Name: "myvol"})
+	if err == nil {
+		t.Fatalf("expected an error when the 'backend' opt is missing")
+	}
+}
+
+func TestPluginBackendDriverRoutesToNamedBackend(t *testing.T) {
+	var gotCreate struct {
+		Name string
+		Opts map[string]string
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/VolumeDriver.Create", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&gotCreate)
+		writeJSON(w, map[string]string{})
+	})
+	mux.HandleFunc("/VolumeDriver.Path", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, volume.PathResponse{Mountpoint: "/mnt/foo/myvol"})
+	})
+
+	addr, closeBackend := newStubBackend(t, mux)
+	defer closeBackend()
+
+	d := NewPluginBackendDriver(map[string]string{"foo": addr})
+	d.statePath = filepath.Join(t.TempDir(), "state.json")
+
+	if err := d.Create(&volume.CreateRequest{Name: "myvol", Options: map[string]string{BackendOpt: "foo", "size": "10G"}}); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	if gotCreate.Name != "myvol" {
+		t.Fatalf("expected the upstream plugin to see the volume name, got %q", gotCreate.Name)
+	}
+
+	resp, err := d.Path(&volume.PathRequest{Name: "myvol"})
+	if err != nil {
+		t.Fatalf("Path: %s", err)
+	}
+	if resp.Mountpoint != "/mnt/foo/myvol" {
+		t.Fatalf("expected the routed backend's response, got %q", resp.Mountpoint)
+	}
+
+	if err := d.Create(&volume.CreateRequest{Name: "myvol", Options: map[string]string{BackendOpt: "foo"}}); err == nil {
+		t.Fatalf("expected re-creating an existing name to fail instead of repointing it")
+	}
+}
+
+func TestPluginBackendDriverRoutingSurvivesRestart(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/VolumeDriver.Create", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{})
+	})
+	mux.HandleFunc("/VolumeDriver.Path", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, volume.PathResponse{Mountpoint: "/mnt/foo/myvol"})
+	})
+
+	addr, closeBackend := newStubBackend(t, mux)
+	defer closeBackend()
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	d1 := NewPluginBackendDriver(map[string]string{"foo": addr})
+	d1.statePath = statePath
+	if err := d1.Create(&volume.CreateRequest{Name: "myvol", Options: map[string]string{BackendOpt: "foo"}}); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+
+	// Simulate a daemon restart: a brand new driver instance, pointed at the
+	// same state file, must still know myvol is routed to "foo".
+	d2 := &pluginBackendDriver{
+		statePath: statePath,
+		backends:  map[string]*pluginClient{"foo": newPluginClient(addr)},
+		volumes:   map[string]string{},
+	}
+	if err := d2.loadState(); err != nil {
+		t.Fatalf("loadState: %s", err)
+	}
+
+	if _, err := d2.Path(&volume.PathRequest{Name: "myvol"}); err != nil {
+		t.Fatalf("expected routing to survive a restart, got: %s", err)
+	}
+}
+
+func TestPluginClientCallSurfacesUpstreamError(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/VolumeDriver.Create", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"Err": "filesystem already in use"})
+	})
+
+	addr, closeBackend := newStubBackend(t, mux)
+	defer closeBackend()
+
+	c := newPluginClient(addr)
+	err := c.call("/VolumeDriver.Create", map[string]string{"Name": "myvol"}, nil)
+	if err == nil {
+		t.Fatalf("expected the upstream Err field to surface as a Go error")
+	}
+	if want := fmt.Sprintf("backend %s: filesystem already in use", addr); err.Error() != want {
+		t.Fatalf("expected %q, got %q", want, err.Error())
+	}
+}
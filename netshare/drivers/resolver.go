@@ -0,0 +1,124 @@
+package drivers
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultResolveTTL is how long a successful lookup is trusted before
+	// it needs re-resolving, used when NewResolver is given a ttl <= 0.
+	DefaultResolveTTL = 5 * time.Minute
+
+	// negativeResolveTTL is how long a failed lookup is cached, just long
+	// enough to stop repeated mount attempts from hammering a down
+	// nameserver without going stale for the default TTL.
+	negativeResolveTTL = 30 * time.Second
+
+	// refreshWindow is how far ahead of expiry an entry is eagerly
+	// refreshed in the background when Resolve is called for it.
+	refreshWindow = 30 * time.Second
+)
+
+// Resolver resolves a hostname to the set of IP addresses it currently
+// answers with. It exists as an interface so efsDriver can swap in a fake
+// lookup function in tests instead of hitting a real nameserver.
+type Resolver interface {
+	Resolve(host string) ([]net.IP, error)
+}
+
+type lookupFunc func(host string) ([]net.IP, error)
+
+type resolveEntry struct {
+	ips        []net.IP
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+// ttlResolver caches lookups for ttl, caches failures for a short negative
+// TTL to avoid stampeding a flapping nameserver, and kicks off a background
+// re-lookup whenever Resolve is called for an entry nearing expiry - the
+// caller still gets the cached value immediately, but the next Resolve is
+// likely to see a fresh one instead of blocking on a cache miss.
+type ttlResolver struct {
+	mu     sync.RWMutex
+	cache  map[string]*resolveEntry
+	ttl    time.Duration
+	lookup lookupFunc
+}
+
+// NewResolver builds a ttlResolver that trusts successful lookups for ttl
+// (DefaultResolveTTL if ttl <= 0).
+func NewResolver(ttl time.Duration) Resolver {
+	if ttl <= 0 {
+		ttl = DefaultResolveTTL
+	}
+	return &ttlResolver{
+		cache:  map[string]*resolveEntry{},
+		ttl:    ttl,
+		lookup: lookupHost,
+	}
+}
+
+func lookupHost(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (r *ttlResolver) Resolve(host string) ([]net.IP, error) {
+	r.mu.RLock()
+	e, ok := r.cache[host]
+	r.mu.RUnlock()
+
+	if ok && time.Now().Before(e.expires) {
+		if e.err == nil && time.Until(e.expires) <= refreshWindow {
+			r.refreshAsync(host)
+		}
+		return e.ips, e.err
+	}
+
+	ips, err := r.lookup(host)
+	r.store(host, ips, err)
+	return ips, err
+}
+
+func (r *ttlResolver) store(host string, ips []net.IP, err error) {
+	ttl := r.ttl
+	if err != nil {
+		ttl = negativeResolveTTL
+	}
+	r.mu.Lock()
+	r.cache[host] = &resolveEntry{ips: ips, err: err, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+}
+
+// refreshAsync kicks off at most one in-flight background re-lookup per
+// host, and none once the cached entry is no longer near expiry (e.g. a
+// refresh already stored a fresh one); the goroutine it starts always returns once that lookup completes,
+// so it never outlives the ttlResolver.
+func (r *ttlResolver) refreshAsync(host string) {
+	r.mu.Lock()
+	e, ok := r.cache[host]
+	if !ok || e.refreshing || time.Until(e.expires) > refreshWindow {
+		r.mu.Unlock()
+		return
+	}
+	e.refreshing = true
+	r.mu.Unlock()
+
+	go func() {
+		ips, err := r.lookup(host)
+		if err != nil {
+			log.Debugf("Background DNS refresh failed for %s: %s\n", host, err.Error())
+			r.mu.Lock()
+			if e, ok := r.cache[host]; ok {
+				e.refreshing = false
+			}
+			r.mu.Unlock()
+			return
+		}
+		r.store(host, ips, nil)
+	}()
+}
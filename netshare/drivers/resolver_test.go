@@ -0,0 +1,126 @@
+package drivers
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLookups is a lookupFunc backed by a canned answer per host, counting
+// how many times each host was actually looked up so tests can assert on
+// caching behavior instead of timing.
+type fakeLookups struct {
+	mu    sync.Mutex
+	ips   map[string][]net.IP
+	err   map[string]error
+	calls int32
+}
+
+func (f *fakeLookups) lookup(host string) ([]net.IP, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err, ok := f.err[host]; ok {
+		return nil, err
+	}
+	return f.ips[host], nil
+}
+
+func (f *fakeLookups) setErr(host string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err == nil {
+		f.err = map[string]error{}
+	}
+	f.err[host] = err
+}
+
+func newResolverWithFake(ttl time.Duration, ips map[string][]net.IP) (*ttlResolver, *fakeLookups) {
+	f := &fakeLookups{ips: ips}
+	r := &ttlResolver{cache: map[string]*resolveEntry{}, ttl: ttl, lookup: f.lookup}
+	return r, f
+}
+
+func TestResolverCachesWithinTTL(t *testing.T) {
+	host := "fs-abc123.us-east-1a.efs.us-east-1.amazonaws.com"
+	r, f := newResolverWithFake(time.Minute, map[string][]net.IP{host: {net.ParseIP("10.0.0.1")}})
+
+	for i := 0; i < 5; i++ {
+		if _, err := r.Resolve(host); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&f.calls); got != 1 {
+		t.Fatalf("expected a single lookup within the TTL window, got %d", got)
+	}
+}
+
+func TestResolverNegativeCachesFailures(t *testing.T) {
+	host := "unresolvable.example.com"
+	r, f := newResolverWithFake(time.Minute, nil)
+	f.setErr(host, fmt.Errorf("no such host"))
+
+	if _, err := r.Resolve(host); err == nil {
+		t.Fatalf("expected an error from the fake lookup")
+	}
+	if _, err := r.Resolve(host); err == nil {
+		t.Fatalf("expected the cached error to still be returned")
+	}
+
+	if got := atomic.LoadInt32(&f.calls); got != 1 {
+		t.Fatalf("expected the second call to be served from the negative cache, got %d lookups", got)
+	}
+
+	r.mu.RLock()
+	expires := r.cache[host].expires
+	r.mu.RUnlock()
+	if time.Until(expires) > negativeResolveTTL {
+		t.Fatalf("expected the failure to be cached for at most negativeResolveTTL")
+	}
+}
+
+func TestResolverRefreshesNearExpiry(t *testing.T) {
+	host := "fs-abc123.us-east-1a.efs.us-east-1.amazonaws.com"
+	// ttl is deliberately huge: the test puts the entry into the
+	// near-expiry window itself, instead of waiting for real time to pass.
+	r, f := newResolverWithFake(time.Hour, map[string][]net.IP{host: {net.ParseIP("10.0.0.1")}})
+
+	if _, err := r.Resolve(host); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := atomic.LoadInt32(&f.calls); got != 1 {
+		t.Fatalf("expected the first Resolve to perform one lookup, got %d", got)
+	}
+
+	r.mu.Lock()
+	r.cache[host].expires = time.Now().Add(refreshWindow / 2)
+	r.mu.Unlock()
+
+	// A flood of concurrent near-expiry Resolve calls must all be served
+	// from cache immediately, and must only trigger a single background
+	// refresh lookup - refreshAsync's per-entry 'refreshing' flag is what
+	// keeps this from stampeding the nameserver.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.Resolve(host); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&f.calls) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&f.calls); got != 2 {
+		t.Fatalf("expected exactly one deduplicated background refresh, got %d total lookups", got)
+	}
+}